@@ -0,0 +1,73 @@
+package scanner
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/server/db"
+	"go.senan.xyz/gonic/server/scanner/probe"
+)
+
+const defaultProbePath = "ffprobe"
+
+// analyzeTrack returns ffprobe-derived duration/bitrate/sample
+// rate/channels/codec for it, preferring a cached db.TrackProbe row over
+// running the ffprobe binary again. the fresh return tells the caller
+// whether the result still needs writing to that cache. ok is false when
+// probing is disabled or the binary can't be run, in which case the
+// caller should fall back to tag-derived values.
+func (s *Scanner) analyzeTrack(it *item) (result probe.Result, fresh bool, ok bool) {
+	if s.ProbeDisabled {
+		return probe.Result{}, false, false
+	}
+	cached := &db.TrackProbe{}
+	err := s.db.
+		Where(db.TrackProbe{
+			Path:    it.relPath,
+			ModTime: it.stat.ModTime().Unix(),
+			Size:    int(it.stat.Size()),
+		}).
+		First(cached).
+		Error
+	if err == nil {
+		return probe.Result{
+			Length:     cached.Length,
+			Bitrate:    cached.Bitrate,
+			SampleRate: cached.SampleRate,
+			Channels:   cached.Channels,
+			Codec:      cached.Codec,
+		}, false, true
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		log.Printf("error reading probe cache for %q: %v", it.fullPath, err)
+	}
+	binPath := s.ProbePath
+	if binPath == "" {
+		binPath = defaultProbePath
+	}
+	analyzed, err := probe.New(binPath).Analyze(it.fullPath)
+	if err != nil {
+		log.Printf("error probing %q, falling back to tags: %v", it.fullPath, err)
+		return probe.Result{}, false, false
+	}
+	return *analyzed, true, true
+}
+
+// writeProbeCache stores a freshly run probe result so a later scan can
+// skip the ffprobe exec for this exact (path, mtime, size).
+func (s *Scanner) writeProbeCache(tx *gorm.DB, it *item, result probe.Result) {
+	cache := &db.TrackProbe{
+		Path:       it.relPath,
+		ModTime:    it.stat.ModTime().Unix(),
+		Size:       int(it.stat.Size()),
+		Length:     result.Length,
+		Bitrate:    result.Bitrate,
+		SampleRate: result.SampleRate,
+		Channels:   result.Channels,
+		Codec:      result.Codec,
+	}
+	if err := tx.Save(cache).Error; err != nil {
+		log.Printf("error writing probe cache for %q: %v", it.fullPath, err)
+	}
+}
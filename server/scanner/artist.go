@@ -0,0 +1,163 @@
+package scanner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/server/db"
+	"go.senan.xyz/gonic/server/scanner/tags"
+)
+
+// ArtistRole is how a resolved artist relates to a track, stored on its
+// db.TrackArtist row.
+type ArtistRole string
+
+const (
+	RoleMain     ArtistRole = "main"
+	RoleFeatured ArtistRole = "featured"
+	RoleRemixer  ArtistRole = "remixer"
+	RoleComposer ArtistRole = "composer"
+)
+
+// defaultArtistSplitPattern separates a raw Artist/AlbumArtist tag value
+// into individual artist names on the separators real-world tags use.
+var defaultArtistSplitPattern = regexp.MustCompile(`\s*(?:;|/| feat\.? | ft\.? | & )\s*`)
+
+// splitArtists breaks raw into individual artist names, using
+// Scanner.ArtistSplitPattern if set.
+func (s *Scanner) splitArtists(raw string) []string {
+	pattern := defaultArtistSplitPattern
+	if s.ArtistSplitPattern != nil {
+		pattern = s.ArtistSplitPattern
+	}
+	var names []string
+	for _, name := range pattern.Split(raw, -1) {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveArtist upserts an artist, preferring a MusicBrainz ID match over
+// a case-insensitive name match, and backfilling brainzID onto an
+// existing name-matched row that doesn't have one yet.
+func (s *Scanner) resolveArtist(tx *gorm.DB, name, brainzID string) (*db.Artist, error) {
+	artist := &db.Artist{}
+	if brainzID != "" {
+		err := tx.Where("brainz_id=?", brainzID).First(artist).Error
+		if err == nil {
+			return artist, nil
+		}
+		if !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+	}
+	err := tx.Where("name=? COLLATE NOCASE", name).First(artist).Error
+	if gorm.IsRecordNotFoundError(err) {
+		artist.Name = name
+		artist.NameUDec = decoded(name)
+		artist.BrainzID = brainzID
+		if err := tx.Save(artist).Error; err != nil {
+			return nil, fmt.Errorf("writing artists table: %w", err)
+		}
+		return artist, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if brainzID != "" && artist.BrainzID == "" {
+		artist.BrainzID = brainzID
+		if err := tx.Save(artist).Error; err != nil {
+			return nil, fmt.Errorf("backfilling artist brainz id: %w", err)
+		}
+	}
+	return artist, nil
+}
+
+// resolveMainArtist is the artist track.ArtistID points at: the album
+// artist if tagged, else the track artist, preferring its MusicBrainz ID
+// and otherwise just the first name if the tag lists several.
+func (s *Scanner) resolveMainArtist(tx *gorm.DB, trTags tags.Tags) (*db.Artist, error) {
+	raw := trTags.AlbumArtist()
+	brainzID := trTags.AlbumArtistBrainzID()
+	if raw == "" {
+		raw = trTags.Artist()
+		brainzID = trTags.ArtistBrainzID()
+	}
+	names := s.splitArtists(raw)
+	if len(names) == 0 {
+		return s.resolveArtist(tx, "Unknown Artist", "")
+	}
+	if len(names) > 1 {
+		brainzID = "" // the MBID tag refers to a single artist, not this list
+	}
+	return s.resolveArtist(tx, names[0], brainzID)
+}
+
+// writeTrackArtists replaces track's db.TrackArtist rows with mainArtist
+// plus every other distinct name parsed out of its Artist/AlbumArtist
+// tags, crediting them all as "featured" since plain tags don't
+// distinguish remixer/composer credits from performer ones.
+func (s *Scanner) writeTrackArtists(tx *gorm.DB, track *db.Track, trTags tags.Tags, mainArtist *db.Artist) error {
+	if err := tx.Where("track_id=?", track.ID).Delete(&db.TrackArtist{}).Error; err != nil {
+		return fmt.Errorf("clearing track artists: %w", err)
+	}
+	assigned := map[int]struct{}{}
+	link := func(artist *db.Artist, role ArtistRole) error {
+		if _, ok := assigned[artist.ID]; ok {
+			return nil
+		}
+		assigned[artist.ID] = struct{}{}
+		return tx.Save(&db.TrackArtist{TrackID: track.ID, ArtistID: artist.ID, Role: string(role)}).Error
+	}
+	if err := link(mainArtist, RoleMain); err != nil {
+		return fmt.Errorf("writing track artist: %w", err)
+	}
+	credit := func(raw, brainzID string) error {
+		names := s.splitArtists(raw)
+		for _, name := range names {
+			id := ""
+			if len(names) == 1 {
+				id = brainzID
+			}
+			artist, err := s.resolveArtist(tx, name, id)
+			if err != nil {
+				return err
+			}
+			if err := link(artist, RoleFeatured); err != nil {
+				return fmt.Errorf("writing track artist: %w", err)
+			}
+		}
+		return nil
+	}
+	if err := credit(trTags.AlbumArtist(), trTags.AlbumArtistBrainzID()); err != nil {
+		return err
+	}
+	if err := credit(trTags.Artist(), trTags.ArtistBrainzID()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// findAlbumByBrainzID looks for another, already-tagged album sharing
+// brainzID - eg. a sibling disc of the same release split across
+// folders - so its artist can be reused instead of re-resolved, keeping
+// credits consistent across the set.
+func (s *Scanner) findAlbumByBrainzID(tx *gorm.DB, brainzID string, excludeID int) *db.Album {
+	if brainzID == "" {
+		return nil
+	}
+	existing := &db.Album{}
+	err := tx.
+		Where("tag_brainz_id=? AND id<>? AND received_tags=1", brainzID, excludeID).
+		First(existing).
+		Error
+	if err != nil {
+		return nil
+	}
+	return existing
+}
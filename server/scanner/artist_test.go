@@ -0,0 +1,34 @@
+package scanner
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestSplitArtistsDefaultPattern(t *testing.T) {
+	s := &Scanner{}
+	got := s.splitArtists("Artist One; Artist Two / Artist Three feat. Artist Four & Artist Five")
+	want := []string{"Artist One", "Artist Two", "Artist Three", "Artist Four", "Artist Five"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("splitArtists() = %#v, want %#v", got, want)
+	}
+}
+
+func TestSplitArtistsDropsEmptyNames(t *testing.T) {
+	s := &Scanner{}
+	got := s.splitArtists(" ; Artist One ;; ")
+	want := []string{"Artist One"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("splitArtists() = %#v, want %#v", got, want)
+	}
+}
+
+func TestSplitArtistsCustomPattern(t *testing.T) {
+	s := &Scanner{ArtistSplitPattern: regexp.MustCompile(`\s*,\s*`)}
+	got := s.splitArtists("Artist One, Artist Two")
+	want := []string{"Artist One", "Artist Two"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("splitArtists() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,362 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/karrick/godirwalk"
+
+	"go.senan.xyz/gonic/server/db"
+	"go.senan.xyz/gonic/server/mime"
+)
+
+// changeSet is the result of a ChangeDetector walk. dirs in changed need
+// their files re-handled, dirs in deleted no longer exist on disk and can
+// be torn down without a walk.
+type changeSet struct {
+	changed []string // relative paths, dirs only
+	deleted []string // relative paths, dirs only
+}
+
+// ChangeDetector walks the music root collecting the effective mtime of
+// every directory and compares it against the last scan time; a directory
+// with no `db.Album` row counts as changed. on most filesystems adding, removing, or
+// replacing a file only bumps the parent directory's mtime and not any
+// ancestor's, so a directory's effective mtime is the max of its own
+// mtime and the mtime of any non-directory child.
+type ChangeDetector struct {
+	db        *db.DB
+	musicPath string
+}
+
+func NewChangeDetector(musicPath string, db *db.DB) *ChangeDetector {
+	return &ChangeDetector{
+		db:        db,
+		musicPath: musicPath,
+	}
+}
+
+func (cd *ChangeDetector) Detect(lastScanTime time.Time) (*changeSet, error) {
+	known, err := cd.knownFolders()
+	if err != nil {
+		return nil, fmt.Errorf("reading known folders: %w", err)
+	}
+	found := map[string]struct{}{}
+	set := &changeSet{}
+	err = godirwalk.Walk(cd.musicPath, &godirwalk.Options{
+		Unsorted:            true,
+		FollowSymbolicLinks: true,
+		Callback: func(fullPath string, info *godirwalk.Dirent) error {
+			isDir, err := info.IsDirOrSymlinkToDir()
+			if err != nil || !isDir {
+				return nil //nolint:nilerr
+			}
+			relPath, err := filepath.Rel(cd.musicPath, fullPath)
+			if err != nil {
+				return fmt.Errorf("getting relative path: %w", err)
+			}
+			found[relPath] = struct{}{}
+			eff, err := cd.effectiveModTime(fullPath)
+			if err != nil {
+				return fmt.Errorf("stating %q: %v", fullPath, err)
+			}
+			if _, ok := known[relPath]; !ok || eff.After(lastScanTime) {
+				set.changed = append(set.changed, relPath)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking filesystem: %w", err)
+	}
+	for relPath := range known {
+		if _, ok := found[relPath]; !ok {
+			set.deleted = append(set.deleted, relPath)
+		}
+	}
+	return set, nil
+}
+
+// knownFolders returns every folder's path (left+right joined) to its
+// last recorded ModifiedAt, so Detect() can work out which folders are
+// missing from disk without a second pass.
+func (cd *ChangeDetector) knownFolders() (map[string]time.Time, error) {
+	var folders []*db.Album
+	err := cd.db.
+		Select("left_path, right_path, modified_at").
+		Find(&folders).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]time.Time, len(folders))
+	for _, f := range folders {
+		known[filepath.Join(f.LeftPath, f.RightPath)] = f.ModifiedAt
+	}
+	return known, nil
+}
+
+// effectiveModTime is the later of dir's own mtime and the mtime of any
+// non-directory child, since a child being added, removed, or replaced
+// usually only bumps its immediate parent.
+func (cd *ChangeDetector) effectiveModTime(dir string) (time.Time, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := stat.ModTime()
+	entries, err := godirwalk.ReadDirents(dir, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, ent := range entries {
+		if ent.IsDir() {
+			continue
+		}
+		childStat, err := os.Stat(filepath.Join(dir, ent.Name()))
+		if err != nil {
+			continue
+		}
+		if childStat.ModTime().After(latest) {
+			latest = childStat.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// startChanged scopes the scan to only the folders the ChangeDetector
+// found to be new or modified, and tears down folders it found missing
+// directly rather than relying on the full `cleanFolders`/`cleanTracks`
+// "not seen" sweep, since unchanged folders never populate
+// `seenTracks`/`seenFolders` in this mode.
+func (s *Scanner) startChanged() error {
+	lastScanTime := s.db.GetSetting("last_scan_time")
+	lastScan, _ := strconv.ParseInt(lastScanTime, 10, 64)
+	detector := NewChangeDetector(s.musicPath, s.db)
+	set, err := detector.Detect(time.Unix(lastScan, 0))
+	if err != nil {
+		return fmt.Errorf("detecting changes: %w", err)
+	}
+	log.Printf("changed scan: %d changed, %d deleted\n", len(set.changed), len(set.deleted))
+	for _, relPath := range set.deleted {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.removeFolder(relPath); err != nil {
+			log.Printf("error removing folder %q: %v", relPath, err)
+		}
+	}
+	for _, relPath := range set.changed {
+		s.reportProgress(relPath)
+		if err := s.scanFolderNonRecursive(relPath); err != nil {
+			if err == s.ctx.Err() {
+				return err
+			}
+			log.Printf("error scanning folder %q: %v", relPath, err)
+		}
+	}
+	// every folder's trTx has committed by now, so any track a pending
+	// playlist references is actually in the db to resolve against.
+	s.resolvePendingPlaylists()
+	return nil
+}
+
+// scanFolderNonRecursive runs the same per-file handling as a full walk,
+// but only over the direct children of relPath, since ChangeDetector
+// already tells us nothing above or below this folder needs visiting.
+func (s *Scanner) scanFolderNonRecursive(relPath string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	fullPath := filepath.Join(s.musicPath, relPath)
+	dirStat, err := os.Stat(fullPath)
+	if err != nil {
+		return fmt.Errorf("stating %q: %w", fullPath, err)
+	}
+	directory, filename := path.Split(relPath)
+	if err := s.handleFolder(&item{
+		fullPath:  fullPath,
+		relPath:   relPath,
+		directory: directory,
+		filename:  filename,
+		stat:      dirStat,
+	}); err != nil {
+		return fmt.Errorf("handling folder: %w", err)
+	}
+	folderAlbumID := s.curFolders.PeekID()
+	entries, err := godirwalk.ReadDirents(fullPath, nil)
+	if err != nil {
+		return fmt.Errorf("reading dir: %w", err)
+	}
+	s.trTx = s.db.Begin()
+	s.trTxOpen = true
+	defer func() {
+		if !s.trTxOpen {
+			return
+		}
+		if s.ctx.Err() != nil {
+			s.trTx.Rollback()
+		} else {
+			s.trTx.Commit()
+		}
+		s.trTxOpen = false
+	}()
+	presentTracks := map[string]struct{}{}
+	for _, ent := range entries {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if ent.IsDir() {
+			continue
+		}
+		childFullPath := filepath.Join(fullPath, ent.Name())
+		stat, err := os.Stat(childFullPath)
+		if err != nil {
+			continue
+		}
+		childRelPath := filepath.Join(relPath, ent.Name())
+		it := &item{
+			fullPath:  childFullPath,
+			relPath:   childRelPath,
+			directory: relPath,
+			filename:  ent.Name(),
+			stat:      stat,
+		}
+		filenameLow := strings.ToLower(ent.Name())
+		if isCover(filenameLow) {
+			s.curFolderCover = ent.Name()
+			continue
+		}
+		if isPlaylist(filenameLow) {
+			// resolved later, once every folder's track writes in this
+			// scan have committed - see resolvePendingPlaylists.
+			s.pendingPlaylists = append(s.pendingPlaylists, it)
+			continue
+		}
+		ext := path.Ext(ent.Name())
+		if ext == "" {
+			continue
+		}
+		if _, ok := mime.FromExtension(ext[1:]); !ok {
+			continue
+		}
+		presentTracks[ent.Name()] = struct{}{}
+		if err := s.handleTrack(it); err != nil {
+			log.Printf("error processing %q: %v", childFullPath, err)
+		}
+	}
+	// a folder surviving with an unchanged effective mtime never reaches
+	// this path at all, so the only way scanFolderNonRecursive runs is
+	// the folder itself changed - which includes a track simply being
+	// deleted from it. since we only re-handle files still on disk, that
+	// deleted track's row would otherwise never get cleaned up.
+	if err := s.cleanStaleTracks(s.trTx, folderAlbumID, presentTracks); err != nil {
+		log.Printf("error cleaning stale tracks in %q: %v", relPath, err)
+	}
+	folder := s.curFolders.Pop()
+	if folder != nil {
+		folder.Cover = s.curFolderCover
+		folder.ParentID = s.parentFolderID(directory)
+		if err := s.db.Save(folder).Error; err != nil {
+			return fmt.Errorf("writing albums table: %w", err)
+		}
+	}
+	s.curFolderCover = ""
+	return nil
+}
+
+// cleanStaleTracks deletes db.Track rows belonging to albumID whose
+// filename isn't in present, mirroring removeFolder but scoped to a
+// single folder's stale tracks rather than tearing the whole folder down
+// - for the case where scanFolderNonRecursive's folder itself survives
+// but one of its tracks was deleted from disk.
+func (s *Scanner) cleanStaleTracks(tx *gorm.DB, albumID int, present map[string]struct{}) error {
+	if albumID == 0 {
+		return nil
+	}
+	var tracks []*db.Track
+	err := tx.
+		Select("id, filename").
+		Where("album_id=?", albumID).
+		Find(&tracks).
+		Error
+	if err != nil {
+		return fmt.Errorf("finding tracks: %w", err)
+	}
+	var stale []int64
+	for _, track := range tracks {
+		if _, ok := present[track.Filename]; !ok {
+			stale = append(stale, int64(track.ID))
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	if err := tx.Where("track_id IN (?)", stale).Delete(&db.TrackArtist{}).Error; err != nil {
+		return fmt.Errorf("deleting track artists: %w", err)
+	}
+	if err := tx.Where(stale).Delete(&db.Track{}).Error; err != nil {
+		return fmt.Errorf("deleting tracks: %w", err)
+	}
+	return nil
+}
+
+// parentFolderID looks up the db.Album id of directory's own parent
+// folder, mirroring how callbackPost reads folder.ParentID off
+// curFolders.PeekID() after a full walk pops the current folder - but
+// scanFolderNonRecursive has no walk stack to read that from, since
+// ChangeDetector hands it one directory at a time with no ancestor
+// context. returns 0 (no parent) for a top-level folder or one whose
+// parent isn't in the db yet.
+func (s *Scanner) parentFolderID(directory string) int {
+	directory = strings.TrimSuffix(directory, "/")
+	if directory == "" {
+		return 0
+	}
+	parentDirectory, parentFilename := path.Split(directory)
+	parent := &db.Album{}
+	err := s.db.
+		Select("id").
+		Where(db.Album{LeftPath: parentDirectory, RightPath: parentFilename}).
+		First(parent).
+		Error
+	if err != nil {
+		return 0
+	}
+	return parent.ID
+}
+
+// removeFolder tears down a folder's tracks and album row directly,
+// without walking, since we already know it no longer exists on disk.
+func (s *Scanner) removeFolder(relPath string) error {
+	directory, filename := path.Split(relPath)
+	folder := &db.Album{}
+	err := s.db.
+		Where(db.Album{LeftPath: directory, RightPath: filename}).
+		First(folder).
+		Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("finding folder: %w", err)
+	}
+	tracks := s.db.Select("id").Model(&db.Track{}).Where("album_id=?", folder.ID).SubQuery()
+	if err := s.db.Where("track_id IN ?", tracks).Delete(&db.TrackArtist{}).Error; err != nil {
+		return fmt.Errorf("deleting track artists: %w", err)
+	}
+	if err := s.db.Where("album_id=?", folder.ID).Delete(&db.Track{}).Error; err != nil {
+		return fmt.Errorf("deleting tracks: %w", err)
+	}
+	if err := s.db.Delete(folder).Error; err != nil {
+		return fmt.Errorf("deleting album: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEffectiveModTimeIsLatestOfDirAndChildren(t *testing.T) {
+	dir := t.TempDir()
+
+	older := time.Now().Add(-time.Hour)
+	newer := time.Now()
+
+	childPath := filepath.Join(dir, "track.flac")
+	if err := os.WriteFile(childPath, nil, 0o644); err != nil {
+		t.Fatalf("writing child: %v", err)
+	}
+	if err := os.Chtimes(childPath, newer, newer); err != nil {
+		t.Fatalf("setting child mtime: %v", err)
+	}
+
+	// set after writing the child, since creating it bumps the dir's mtime
+	if err := os.Chtimes(dir, older, older); err != nil {
+		t.Fatalf("setting dir mtime: %v", err)
+	}
+
+	cd := &ChangeDetector{musicPath: dir}
+	got, err := cd.effectiveModTime(dir)
+	if err != nil {
+		t.Fatalf("effectiveModTime: %v", err)
+	}
+	if !got.After(older) {
+		t.Fatalf("effectiveModTime() = %v, want something after the dir's own mtime %v (the newer child should win)", got, older)
+	}
+}
+
+func TestEffectiveModTimeIgnoresChildDirs(t *testing.T) {
+	dir := t.TempDir()
+
+	childDir := filepath.Join(dir, "subdir")
+	if err := os.Mkdir(childDir, 0o755); err != nil {
+		t.Fatalf("making subdir: %v", err)
+	}
+	newer := time.Now()
+	if err := os.Chtimes(childDir, newer, newer); err != nil {
+		t.Fatalf("setting subdir mtime: %v", err)
+	}
+
+	// set after making the subdir, since creating it bumps the dir's mtime
+	dirMTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir, dirMTime, dirMTime); err != nil {
+		t.Fatalf("setting dir mtime: %v", err)
+	}
+	dirStat, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("stating dir: %v", err)
+	}
+
+	cd := &ChangeDetector{musicPath: dir}
+	got, err := cd.effectiveModTime(dir)
+	if err != nil {
+		t.Fatalf("effectiveModTime: %v", err)
+	}
+	if !got.Equal(dirStat.ModTime()) {
+		t.Fatalf("effectiveModTime() = %v, want unchanged dir mtime %v (child dirs shouldn't count)", got, dirStat.ModTime())
+	}
+}
@@ -0,0 +1,203 @@
+package scanner
+
+import (
+	"log"
+	"runtime"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/server/db"
+	"go.senan.xyz/gonic/server/scanner/probe"
+	"go.senan.xyz/gonic/server/scanner/tags"
+)
+
+// trackBatchSize is how many decoded tracks the writer accumulates
+// before opening a transaction and committing them together.
+const trackBatchSize = 100
+
+// trackJob is a candidate track path the walk has queued for tag
+// decoding. folder is captured at enqueue time, since album resolution
+// already happened synchronously as the walk entered the directory.
+type trackJob struct {
+	it     *item
+	folder *db.Album
+}
+
+// trackParsed is what a worker hands the writer once it's read a job's
+// tags (and, unless disabled, probed its audio streams) off disk.
+type trackParsed struct {
+	job        trackJob
+	tags       tags.Tags
+	probe      probe.Result
+	probeFresh bool // probe still needs writing to the db.TrackProbe cache
+	probeOK    bool // probe holds a usable result; false falls back to tags
+	err        error
+}
+
+func defaultPipelineWorkers() int {
+	if n := runtime.NumCPU(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// writerOp is a one-off write the writer goroutine should run in its own
+// transaction, ahead of whatever track batch is pending - used for the
+// album writes that happen directly on the walk goroutine
+// (callbackPost, handleFolder) so they never hit the
+// database concurrently with writeBatch's commit. done, if non-nil, is
+// how the caller waits for the result.
+type writerOp struct {
+	write func(tx *gorm.DB) error
+	done  chan<- error
+}
+
+// runPipeline starts a pool of tag-decoding workers and a single
+// DB-writer goroutine that drains their output in batches. it returns the
+// channel the walk should push candidate tracks onto, the channel
+// Scanner.enqueueWrite uses for one-off writes, and a function that
+// closes both and blocks until every in-flight batch has committed - the
+// end-of-scan barrier cleanup relies on.
+func (s *Scanner) runPipeline(workers int) (chan<- trackJob, chan<- writerOp, func()) {
+	jobs := make(chan trackJob, workers*4) // bounded: backpressure on the walk
+	writes := make(chan writerOp, workers*4)
+	results := make(chan trackParsed, workers*4)
+
+	var workerWG sync.WaitGroup
+	workerWG.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer workerWG.Done()
+			for job := range jobs {
+				trTags, err := tags.New(job.it.fullPath)
+				if err != nil {
+					results <- trackParsed{job: job, err: ErrReadingTags}
+					continue
+				}
+				probeResult, probeFresh, probeOK := s.analyzeTrack(job.it)
+				results <- trackParsed{
+					job: job, tags: trTags,
+					probe: probeResult, probeFresh: probeFresh, probeOK: probeOK,
+				}
+			}
+		}()
+	}
+	go func() {
+		workerWG.Wait()
+		close(results)
+	}()
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		s.drainWrites(results, writes)
+	}()
+
+	return jobs, writes, func() {
+		close(jobs)
+		close(writes)
+		<-writerDone
+	}
+}
+
+// drainWrites is the single DB-writer goroutine: it batches parsed tracks
+// and commits them trackBatchSize at a time, and interleaves one-off
+// writerOps (flushing the pending batch first) so every write made during
+// a full/quick scan's walk - batched tracks and one-off album rows alike -
+// goes through this one goroutine, preserving SQLite's single-writer
+// invariant while tag decoding happens in parallel. playlist and cleanup
+// writes happen after it has exited.
+func (s *Scanner) drainWrites(results <-chan trackParsed, writes <-chan writerOp) {
+	batch := make([]trackParsed, 0, trackBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.writeBatch(batch); err != nil {
+			log.Printf("error writing batch: %v", err)
+		}
+		batch = batch[:0]
+	}
+	for results != nil || writes != nil {
+		select {
+		case parsed, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			batch = append(batch, parsed)
+			if len(batch) >= trackBatchSize {
+				flush()
+			}
+		case op, ok := <-writes:
+			if !ok {
+				writes = nil
+				continue
+			}
+			flush()
+			err := s.withWriteTx(op.write)
+			if op.done != nil {
+				op.done <- err
+			}
+		}
+	}
+	flush()
+}
+
+func (s *Scanner) writeBatch(batch []trackParsed) error {
+	return s.withWriteTx(func(tx *gorm.DB) error {
+		for _, parsed := range batch {
+			if parsed.err != nil {
+				log.Printf("error reading tags for %q: %v", parsed.job.it.fullPath, parsed.err)
+				continue
+			}
+			err := s.writeTrackTags(tx, parsed.job.it, parsed.job.folder, parsed.tags,
+				parsed.probe, parsed.probeFresh, parsed.probeOK)
+			if err != nil {
+				log.Printf("error writing %q: %v", parsed.job.it.fullPath, err)
+				continue
+			}
+		}
+		return nil
+	})
+}
+
+// withWriteTx runs fn in its own transaction, rolling back instead of
+// committing if the scan's been cancelled in the meantime.
+func (s *Scanner) withWriteTx(fn func(tx *gorm.DB) error) error {
+	tx := s.db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := s.ctx.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// enqueueWrite runs fn against the database, serialized with every other
+// write a pipelined (full/quick) scan is making, since fn may otherwise
+// run on the walk goroutine concurrently with the writer goroutine's
+// batch commits. outside a pipelined scan (s.writes is nil, eg. the
+// "changed" mode's synchronous path) it just runs fn directly, since
+// there's only one goroutine touching the db there.
+func (s *Scanner) enqueueWrite(fn func(tx *gorm.DB) error) error {
+	if s.writes == nil {
+		return s.withWriteTx(fn)
+	}
+	done := make(chan error, 1)
+	select {
+	case s.writes <- writerOp{write: fn, done: done}:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
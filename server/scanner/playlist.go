@@ -0,0 +1,254 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/server/db"
+)
+
+// defaultPlaylistUser is who playlists found on disk are attributed to
+// when Scanner.PlaylistUser isn't set.
+const defaultPlaylistUser = "gonic"
+
+func isPlaylist(filename string) bool {
+	switch path.Ext(filename) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	}
+	return false
+}
+
+// handlePlaylist parses a .m3u/.m3u8/.pls file found during the walk and
+// upserts the matching db.Playlist, owned by Scanner.PlaylistUser. it
+// only re-parses when the file's mtime is newer than what we stored last
+// time, since playlists can reference hundreds of tracks.
+func (s *Scanner) handlePlaylist(it *item) error {
+	user, err := s.playlistUser()
+	if err != nil {
+		return fmt.Errorf("finding playlist user: %w", err)
+	}
+	playlist := &db.Playlist{}
+	err = s.db.
+		Where("user_id=? AND path=?", user.ID, it.relPath).
+		First(playlist).
+		Error
+	if !gorm.IsRecordNotFoundError(err) {
+		if err != nil {
+			return fmt.Errorf("finding playlist: %w", err)
+		}
+		if !it.stat.ModTime().After(playlist.UpdatedAt) {
+			s.markPlaylistSeen(playlist.ID)
+			return nil
+		}
+	}
+	entries, err := parsePlaylistFile(it.fullPath)
+	if err != nil {
+		return fmt.Errorf("parsing playlist: %w", err)
+	}
+	trackIDs := s.resolvePlaylistEntries(it.fullPath, entries)
+	playlist.UserID = user.ID
+	playlist.Path = it.relPath
+	playlist.Name = strings.TrimSuffix(it.filename, path.Ext(it.filename))
+	playlist.Items = joinIDs(trackIDs)
+	err = s.enqueueWrite(func(tx *gorm.DB) error {
+		return tx.Save(playlist).Error
+	})
+	if err != nil {
+		return fmt.Errorf("writing playlist table: %w", err)
+	}
+	s.markPlaylistSeen(playlist.ID)
+	log.Printf("imported playlist `%s` (%d tracks)\n", it.relPath, len(trackIDs))
+	return nil
+}
+
+// resolvePendingPlaylists handles every playlist item the walk queued
+// onto Scanner.pendingPlaylists instead of resolving inline, now that the
+// tracks it might reference have actually been written: a playlist and
+// its sibling tracks are often discovered in the same pass, but under the
+// pipeline those tracks are only queued for async tag decoding at that
+// point, and even in "changed" mode they're written inside a per-folder
+// transaction that's still open. resolving here, after every relevant
+// track write has committed, is what lets resolveTrackID actually find
+// them instead of silently dropping most entries.
+func (s *Scanner) resolvePendingPlaylists() {
+	for _, it := range s.pendingPlaylists {
+		if err := s.handlePlaylist(it); err != nil {
+			log.Printf("error processing playlist %q: %v", it.fullPath, err)
+		}
+	}
+	s.pendingPlaylists = nil
+}
+
+func (s *Scanner) playlistUser() (*db.User, error) {
+	name := s.PlaylistUser
+	if name == "" {
+		name = defaultPlaylistUser
+	}
+	user := &db.User{}
+	err := s.db.Where("name=?", name).First(user).Error
+	if gorm.IsRecordNotFoundError(err) {
+		user.Name = name
+		err := s.enqueueWrite(func(tx *gorm.DB) error {
+			return tx.Save(user).Error
+		})
+		if err != nil {
+			return nil, fmt.Errorf("writing users table: %w", err)
+		}
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// resolvePlaylistEntries turns a playlist's raw path entries into track
+// IDs, resolving relative entries against the playlist file's own
+// directory and absolute entries as-is.
+func (s *Scanner) resolvePlaylistEntries(playlistFullPath string, entries []string) []int {
+	playlistDir := filepath.Dir(playlistFullPath)
+	var ids []int
+	for _, entry := range entries {
+		entry = strings.ReplaceAll(entry, `\`, `/`)
+		abs := entry
+		if !filepath.IsAbs(entry) {
+			abs = filepath.Join(playlistDir, entry)
+		}
+		relPath, err := filepath.Rel(s.musicPath, abs)
+		if err != nil {
+			continue
+		}
+		id, ok := s.resolveTrackID(relPath)
+		if !ok {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// resolveTrackID matches a path relative to the music root against
+// db.Track.Filename and the owning db.Album's left/right path.
+func (s *Scanner) resolveTrackID(relPath string) (int, bool) {
+	directory, filename := path.Split(relPath)
+	albumDirectory, albumFilename := path.Split(strings.TrimSuffix(directory, "/"))
+	var track db.Track
+	err := s.db.
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("tracks.filename=? AND albums.left_path=? AND albums.right_path=?",
+			filename, albumDirectory, albumFilename).
+		First(&track).
+		Error
+	if err != nil {
+		return 0, false
+	}
+	return track.ID, true
+}
+
+func joinIDs(ids []int) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.Itoa(id)
+	}
+	return strings.Join(strs, ",")
+}
+
+// parsePlaylistFile returns a playlist's raw, unresolved path entries in
+// order, in whichever of the two supported formats fullPath is.
+func parsePlaylistFile(fullPath string) ([]string, error) {
+	if strings.EqualFold(path.Ext(fullPath), ".pls") {
+		return parsePLS(fullPath)
+	}
+	return parseM3U(fullPath)
+}
+
+// parseM3U reads an m3u/m3u8 playlist, skipping the #EXTM3U header and
+// #EXTINF comment lines.
+func parseM3U(fullPath string) ([]string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scan.Err()
+}
+
+// parsePLS reads a pls playlist's FileN=... lines, in order of N.
+func parsePLS(fullPath string) ([]string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	byIndex := map[int]string{}
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if !strings.HasPrefix(line, "File") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(strings.TrimPrefix(kv[0], "File"))
+		if err != nil {
+			continue
+		}
+		byIndex[idx] = kv[1]
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	indices := make([]int, 0, len(byIndex))
+	for idx := range byIndex {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	entries := make([]string, 0, len(indices))
+	for _, idx := range indices {
+		entries = append(entries, byIndex[idx])
+	}
+	return entries, nil
+}
+
+func (s *Scanner) cleanPlaylists() (int, error) {
+	var previous []int
+	var missing []int64
+	err := s.db.
+		Model(&db.Playlist{}).
+		Where("path != ''").
+		Pluck("id", &previous).
+		Error
+	if err != nil {
+		return 0, fmt.Errorf("plucking ids: %w", err)
+	}
+	for _, prev := range previous {
+		if !s.isPlaylistSeen(prev) {
+			missing = append(missing, int64(prev))
+		}
+	}
+	err = s.db.TransactionChunked(missing, func(tx *gorm.DB, chunk []int64) error {
+		return tx.Where(chunk).Delete(&db.Playlist{}).Error
+	})
+	return len(missing), err
+}
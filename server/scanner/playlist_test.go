@@ -0,0 +1,61 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTemp(t *testing.T, name, contents string) string {
+	t.Helper()
+	fullPath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fullPath, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing %q: %v", fullPath, err)
+	}
+	return fullPath
+}
+
+func TestParseM3USkipsHeaderAndComments(t *testing.T) {
+	fullPath := writeTemp(t, "test.m3u", ""+
+		"#EXTM3U\n"+
+		"#EXTINF:123,Some Artist - Some Track\n"+
+		"../Some Artist/Some Album/01 Some Track.flac\n"+
+		"\n"+
+		"/abs/path/02 Another Track.flac\n")
+
+	got, err := parseM3U(fullPath)
+	if err != nil {
+		t.Fatalf("parseM3U: %v", err)
+	}
+	want := []string{
+		"../Some Artist/Some Album/01 Some Track.flac",
+		"/abs/path/02 Another Track.flac",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseM3U() = %#v, want %#v", got, want)
+	}
+}
+
+func TestParsePLSOrdersByFileIndex(t *testing.T) {
+	fullPath := writeTemp(t, "test.pls", ""+
+		"[playlist]\n"+
+		"File2=../Artist/Album/02 Track.flac\n"+
+		"Title2=Track Two\n"+
+		"File1=../Artist/Album/01 Track.flac\n"+
+		"Title1=Track One\n"+
+		"NumberOfEntries=2\n"+
+		"Version=2\n")
+
+	got, err := parsePLS(fullPath)
+	if err != nil {
+		t.Fatalf("parsePLS: %v", err)
+	}
+	want := []string{
+		"../Artist/Album/01 Track.flac",
+		"../Artist/Album/02 Track.flac",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parsePLS() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+// Package probe extracts authoritative audio stream info - duration,
+// bitrate, sample rate, channel count, and codec - by shelling out to
+// ffprobe, since those values in file tags are frequently wrong or
+// missing altogether.
+package probe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Result is what a single Analyze call produces.
+type Result struct {
+	Length     int // seconds
+	Bitrate    int // bits per second
+	SampleRate int // hz
+	Channels   int
+	Codec      string
+}
+
+type output struct {
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType  string `json:"codec_type"`
+		CodecName  string `json:"codec_name"`
+		SampleRate string `json:"sample_rate"`
+		Channels   int    `json:"channels"`
+	} `json:"streams"`
+}
+
+// Analyzer runs ffprobe at BinPath against a file.
+type Analyzer struct {
+	BinPath string
+}
+
+// New returns an Analyzer using binPath, or the "ffprobe" found on $PATH
+// if binPath is empty.
+func New(binPath string) *Analyzer {
+	if binPath == "" {
+		binPath = "ffprobe"
+	}
+	return &Analyzer{BinPath: binPath}
+}
+
+func (a *Analyzer) Analyze(path string) (*Result, error) {
+	cmd := exec.Command(a.BinPath, //nolint:gosec
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running ffprobe: %w", err)
+	}
+	var out output
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("parsing ffprobe output: %w", err)
+	}
+	result := &Result{}
+	if dur, err := strconv.ParseFloat(out.Format.Duration, 64); err == nil {
+		result.Length = int(dur)
+	}
+	if bitrate, err := strconv.Atoi(out.Format.BitRate); err == nil {
+		result.Bitrate = bitrate
+	}
+	for _, stream := range out.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		result.Codec = stream.CodecName
+		result.Channels = stream.Channels
+		if sampleRate, err := strconv.Atoi(stream.SampleRate); err == nil {
+			result.SampleRate = sampleRate
+		}
+		break
+	}
+	return result, nil
+}
@@ -1,15 +1,17 @@
 package scanner
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -18,12 +20,14 @@ import (
 
 	"go.senan.xyz/gonic/server/db"
 	"go.senan.xyz/gonic/server/mime"
+	"go.senan.xyz/gonic/server/scanner/probe"
 	"go.senan.xyz/gonic/server/scanner/stack"
 	"go.senan.xyz/gonic/server/scanner/tags"
 )
 
 var (
 	ErrAlreadyScanning = errors.New("already scanning")
+	ErrNotScanning     = errors.New("not scanning")
 	ErrStatingItem     = errors.New("could not stat item")
 	ErrReadingTags     = errors.New("could not read tags")
 )
@@ -42,21 +46,6 @@ func decoded(in string) string {
 	return ""
 }
 
-// isScanning acts as an atomic boolean semaphore. we don't
-// want to have more than one scan going on at a time
-var isScanning int32 //nolint:gochecknoglobals
-
-func IsScanning() bool {
-	return atomic.LoadInt32(&isScanning) == 1
-}
-
-func SetScanning() func() {
-	atomic.StoreInt32(&isScanning, 1)
-	return func() {
-		atomic.StoreInt32(&isScanning, 0)
-	}
-}
-
 type Scanner struct {
 	db        *db.DB
 	musicPath string
@@ -72,19 +61,111 @@ type Scanner struct {
 	// callback
 	curFolders     *stack.Stack
 	curFolderCover string
-	// then the rest are for stats and cleanup at the very end
+	// pendingPlaylists accumulates playlist items found during the walk,
+	// so they can be resolved once every track write they might reference
+	// has actually committed - see resolvePendingPlaylists.
+	pendingPlaylists []*item
+	// then the rest are for stats and cleanup at the very end. seenMu
+	// guards all four, since during a pipelined full/quick scan they're
+	// written from the writer goroutine (writeTrackTags) while
+	// reportProgress reads them from the walk goroutine.
+	seenMu        sync.Mutex
 	seenTracks    map[int]struct{} // set of p keys
 	seenFolders   map[int]struct{} // set of p keys
+	seenPlaylists map[int]struct{} // set of p keys
 	seenTracksNew int              // n tracks not seen before
+	// pipelineWorkers is how many goroutines decode tags concurrently
+	// during a full/quick scan. jobs is only non-nil while such a scan
+	// is running; the walk callback sends candidate tracks to it instead
+	// of reading and writing them inline.
+	pipelineWorkers int
+	jobs            chan<- trackJob
+	writes          chan<- writerOp
+	// PlaylistUser is who playlists found on disk during a scan are
+	// attributed to. defaults to "gonic" if unset.
+	PlaylistUser string
+	// ProbePath overrides the ffprobe binary used to extract authoritative
+	// duration/bitrate/sample rate/channels/codec. defaults to "ffprobe"
+	// on $PATH if unset. ProbeDisabled skips probing entirely, falling
+	// back to tag-derived duration and bitrate.
+	ProbePath     string
+	ProbeDisabled bool
+	// ArtistSplitPattern overrides the regex used to split a raw Artist/
+	// AlbumArtist tag into individual artist names. defaults to splitting
+	// on ";", "/", "&", and "feat."/"ft." if unset.
+	ArtistSplitPattern *regexp.Regexp
+	// progress tracks this scan's status for Status()/Cancel(), and ctx
+	// is checked by the walk callbacks and handlers so a Cancel() call
+	// actually stops a scan in progress.
+	progress progress
+	ctx      context.Context
 }
 
 func New(musicPath string, db *db.DB) *Scanner {
 	return &Scanner{
-		db:        db,
-		musicPath: musicPath,
+		db:              db,
+		musicPath:       musicPath,
+		pipelineWorkers: defaultPipelineWorkers(),
 	}
 }
 
+// ## begin seen tracking, guarded by seenMu
+// ## begin seen tracking, guarded by seenMu
+// ## begin seen tracking, guarded by seenMu
+
+func (s *Scanner) markTrackSeen(id int) {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	s.seenTracks[id] = struct{}{}
+}
+
+func (s *Scanner) incTracksNew() {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	s.seenTracksNew++
+}
+
+func (s *Scanner) markFolderSeen(id int) {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	s.seenFolders[id] = struct{}{}
+}
+
+func (s *Scanner) markPlaylistSeen(id int) {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	s.seenPlaylists[id] = struct{}{}
+}
+
+func (s *Scanner) isTrackSeen(id int) bool {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	_, ok := s.seenTracks[id]
+	return ok
+}
+
+func (s *Scanner) isFolderSeen(id int) bool {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	_, ok := s.seenFolders[id]
+	return ok
+}
+
+func (s *Scanner) isPlaylistSeen(id int) bool {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	_, ok := s.seenPlaylists[id]
+	return ok
+}
+
+// seenProgress returns the running file counters reportProgress logs and
+// exposes through Status().
+func (s *Scanner) seenProgress() (filesSeen, filesNew int) {
+	s.seenMu.Lock()
+	defer s.seenMu.Unlock()
+	return len(s.seenTracks), s.seenTracksNew
+}
+
 // ## begin clean funcs
 // ## begin clean funcs
 // ## begin clean funcs
@@ -100,11 +181,14 @@ func (s *Scanner) cleanTracks() (int, error) {
 		return 0, fmt.Errorf("plucking ids: %w", err)
 	}
 	for _, prev := range previous {
-		if _, ok := s.seenTracks[prev]; !ok {
+		if !s.isTrackSeen(prev) {
 			missing = append(missing, int64(prev))
 		}
 	}
 	err = s.db.TransactionChunked(missing, func(tx *gorm.DB, chunk []int64) error {
+		if err := tx.Where("track_id IN (?)", chunk).Delete(&db.TrackArtist{}).Error; err != nil {
+			return fmt.Errorf("deleting track artists: %w", err)
+		}
 		return tx.Where(chunk).Delete(&db.Track{}).Error
 	})
 	return len(missing), err
@@ -121,7 +205,7 @@ func (s *Scanner) cleanFolders() (int, error) {
 		return 0, fmt.Errorf("plucking ids: %w", err)
 	}
 	for _, prev := range previous {
-		if _, ok := s.seenFolders[prev]; !ok {
+		if !s.isFolderSeen(prev) {
 			missing = append(missing, int64(prev))
 		}
 	}
@@ -132,13 +216,18 @@ func (s *Scanner) cleanFolders() (int, error) {
 }
 
 func (s *Scanner) cleanArtists() (int, error) {
-	sub := s.db.
+	subAlbum := s.db.
 		Select("1").
 		Model(&db.Album{}).
 		Where("albums.tag_artist_id=artists.id").
 		SubQuery()
+	subTrackArtist := s.db.
+		Select("1").
+		Model(&db.TrackArtist{}).
+		Where("track_artists.artist_id=artists.id").
+		SubQuery()
 	q := s.db.
-		Where("NOT EXISTS ?", sub).
+		Where("NOT EXISTS ? AND NOT EXISTS ?", subAlbum, subTrackArtist).
 		Delete(&db.Artist{})
 	return int(q.RowsAffected), q.Error
 }
@@ -147,26 +236,78 @@ func (s *Scanner) cleanArtists() (int, error) {
 // ## begin entries
 // ## begin entries
 
+// ScanMode controls how much of the music root Start() actually walks.
+type ScanMode string
+
+const (
+	ScanModeFull    ScanMode = "full"    // walk everything, ignoring stored mtimes
+	ScanModeQuick   ScanMode = "quick"   // walk everything, skip files whose mtime is unchanged
+	ScanModeChanged ScanMode = "changed" // skip traversal of directories whose effective mtime is unchanged
+)
+
+// ParseScanMode parses the mode value an admin scan-trigger form/query
+// parameter would carry into a ScanMode, so the admin handler doesn't
+// have to duplicate the three valid values (or silently accept a typo as
+// ScanModeFull, the zero value). ok is false for anything else, including
+// the empty string.
+func ParseScanMode(raw string) (ScanMode, bool) {
+	switch mode := ScanMode(raw); mode {
+	case ScanModeFull, ScanModeQuick, ScanModeChanged:
+		return mode, true
+	default:
+		return "", false
+	}
+}
+
 type ScanOptions struct {
-	IsFull bool
+	Mode ScanMode
+	// Workers overrides the number of goroutines used to decode tags
+	// concurrently during a full/quick scan. 0 means runtime.NumCPU().
+	Workers int
 	// TODO https://github.com/sentriz/gonic/issues/64
 	Path string
 }
 
-func (s *Scanner) Start(opts ScanOptions) error {
-	if IsScanning() {
+func (s *Scanner) Start(ctx context.Context, opts ScanOptions) error {
+	if s.Status().Scanning {
 		return ErrAlreadyScanning
 	}
-	unSet := SetScanning()
-	defer unSet()
+	ctx, cancel := context.WithCancel(ctx)
+	s.ctx = ctx
+	s.startProgress(cancel)
+	defer s.finishProgress()
 	// reset state vars for the new scan
-	s.isFull = opts.IsFull
+	s.isFull = opts.Mode == ScanModeFull
 	s.seenTracks = map[int]struct{}{}
 	s.seenFolders = map[int]struct{}{}
+	s.seenPlaylists = map[int]struct{}{}
 	s.curFolders = &stack.Stack{}
 	s.seenTracksNew = 0
+	s.pendingPlaylists = nil
+	// these are only live for the duration of a pipelined full/quick scan;
+	// nil them out so a "changed" scan's enqueueWrite calls fall back to
+	// writing directly instead of sending on a stale, closed channel.
+	s.jobs = nil
+	s.writes = nil
+	if opts.Mode == ScanModeChanged {
+		start := time.Now()
+		err := s.startChanged()
+		filesSeen, filesNew := s.seenProgress()
+		log.Printf("finished changed scan in %s, +%d/%d tracks\n",
+			durSince(start), filesNew, filesSeen)
+		strNow := strconv.FormatInt(time.Now().Unix(), 10)
+		s.db.SetSetting("last_scan_time", strNow)
+		return err
+	}
 	// ** begin being walking
 	log.Println("starting scan")
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = s.pipelineWorkers
+	}
+	jobs, writes, awaitWritten := s.runPipeline(workers)
+	s.jobs = jobs
+	s.writes = writes
 	var errCount int
 	start := time.Now()
 	err := godirwalk.Walk(s.musicPath, &godirwalk.Options{
@@ -177,19 +318,34 @@ func (s *Scanner) Start(opts ScanOptions) error {
 		ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
 			log.Printf("error processing %q: %v", path, err)
 			errCount++
+			s.recordError()
 			return godirwalk.SkipNode
 		},
 	})
+	// the walk is done, but tag decoding and DB writes are happening on
+	// other goroutines. wait for every in-flight batch to commit (or roll
+	// back, if we were cancelled) before cleaning up, since
+	// cleanTracks/cleanFolders rely on seenTracks and seenFolders being
+	// fully populated.
+	awaitWritten()
+	// the pipeline's writer goroutine has now exited, so nothing else is
+	// touching the db - safe for resolvePendingPlaylists to write directly
+	// via enqueueWrite's non-pipelined fallback instead of sending on the
+	// now-closed writes channel.
+	s.writes = nil
+	s.resolvePendingPlaylists()
 	if err != nil {
 		return fmt.Errorf("walking filesystem: %w", err)
 	}
+	filesSeen, filesNew := s.seenProgress()
 	log.Printf("finished scan in %s, +%d/%d tracks (%d err)\n",
 		durSince(start),
-		s.seenTracksNew,
-		len(s.seenTracks),
+		filesNew,
+		filesSeen,
 		errCount,
 	)
 	// ** begin cleaning
+	s.setPhase(PhaseCleaning)
 	cleanFuncs := []struct {
 		name string
 		f    func() (int, error)
@@ -197,6 +353,7 @@ func (s *Scanner) Start(opts ScanOptions) error {
 		{name: "tracks", f: s.cleanTracks},
 		{name: "folders", f: s.cleanFolders},
 		{name: "artists", f: s.cleanArtists},
+		{name: "playlists", f: s.cleanPlaylists},
 	}
 	for _, clean := range cleanFuncs {
 		start = time.Now()
@@ -248,6 +405,10 @@ func isCover(filename string) bool {
 // ## begin callbacks
 
 func (s *Scanner) callbackItem(fullPath string, info *godirwalk.Dirent) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.reportProgress(fullPath)
 	stat, err := os.Stat(fullPath)
 	if err != nil {
 		return fmt.Errorf("%w: %v", ErrStatingItem, err)
@@ -272,10 +433,6 @@ func (s *Scanner) callbackItem(fullPath string, info *godirwalk.Dirent) error {
 		if f := s.curFolders.Peek(); f != nil {
 			f.HasTracksOrDir = true
 		}
-		if s.trTxOpen {
-			s.trTx.Commit()
-			s.trTxOpen = false
-		}
 		return s.handleFolder(it)
 	}
 	filenameLow := strings.ToLower(filename)
@@ -283,31 +440,43 @@ func (s *Scanner) callbackItem(fullPath string, info *godirwalk.Dirent) error {
 		s.curFolderCover = filename
 		return nil
 	}
+	if isPlaylist(filenameLow) {
+		// resolved later, once every in-flight track write has committed -
+		// see resolvePendingPlaylists. sibling tracks in the same folder
+		// are still only queued on s.jobs at this point, not yet in the
+		// db, so resolving inline here would silently drop most entries.
+		s.pendingPlaylists = append(s.pendingPlaylists, it)
+		return nil
+	}
 	ext := path.Ext(filename)
 	if ext == "" {
 		return nil
 	}
 	if _, ok := mime.FromExtension(ext[1:]); ok {
-		if f := s.curFolders.Peek(); f != nil {
-			f.HasTracksOrDir = true
+		folder := s.curFolders.Peek()
+		if folder != nil {
+			folder.HasTracksOrDir = true
 		}
-		if !s.trTxOpen {
-			s.trTx = s.db.Begin()
-			s.trTxOpen = true
+		// tag decoding happens off the walk goroutine; the worker pool
+		// and writer pick this job up from here on. select on ctx too,
+		// so a Cancel() unblocks us even if the queue is full
+		select {
+		case s.jobs <- trackJob{it: it, folder: folder}:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
 		}
-		return s.handleTrack(it)
+		return nil
 	}
 	return nil
 }
 
 func (s *Scanner) callbackPost(fullPath string, info *godirwalk.Dirent) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
 	defer func() {
 		s.curFolderCover = ""
 	}()
-	if s.trTxOpen {
-		s.trTx.Commit()
-		s.trTxOpen = false
-	}
 	// begin taking the current folder off the stack and add it's
 	// parent, cover that we found, etc.
 	folder := s.curFolders.Pop()
@@ -316,7 +485,10 @@ func (s *Scanner) callbackPost(fullPath string, info *godirwalk.Dirent) error {
 	}
 	folder.ParentID = s.curFolders.PeekID()
 	folder.Cover = s.curFolderCover
-	if err := s.db.Save(folder).Error; err != nil {
+	err := s.enqueueWrite(func(tx *gorm.DB) error {
+		return tx.Save(folder).Error
+	})
+	if err != nil {
 		return fmt.Errorf("writing albums table: %w", err)
 	}
 	// we only log changed folders
@@ -337,11 +509,14 @@ func (s *Scanner) itemUnchanged(statModTime, updatedInDB time.Time) bool {
 }
 
 func (s *Scanner) handleFolder(it *item) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
 	folder := &db.Album{}
 	defer func() {
 		// folder's id will come from early return
 		// or save at the end
-		s.seenFolders[folder.ID] = struct{}{}
+		s.markFolderSeen(folder.ID)
 		s.curFolders.Push(folder)
 	}()
 	err := s.db.
@@ -361,25 +536,57 @@ func (s *Scanner) handleFolder(it *item) error {
 	folder.RightPath = it.filename
 	folder.RightPathUDec = decoded(it.filename)
 	folder.ModifiedAt = it.stat.ModTime()
-	if err := s.db.Save(folder).Error; err != nil {
+	err = s.enqueueWrite(func(tx *gorm.DB) error {
+		return tx.Save(folder).Error
+	})
+	if err != nil {
 		return fmt.Errorf("writing albums table: %w", err)
 	}
 	folder.ReceivedPaths = true
 	return nil
 }
 
+// handleTrack reads a track's tags inline and writes it within the
+// current folder's transaction. used by the synchronous "changed" scan
+// mode, where a folder's handful of tracks don't warrant spinning up the
+// worker pool. full/quick scans go through the pipeline instead, which
+// decodes tags on a pool of workers and calls writeTrackTags directly
+// once a worker's already done the I/O.
 func (s *Scanner) handleTrack(it *item) error {
-	// ** begin set track basics
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	trTags, err := tags.New(it.fullPath)
+	if err != nil {
+		return ErrReadingTags
+	}
+	probeResult, probeFresh, probeOK := s.analyzeTrack(it)
+	return s.writeTrackTags(s.trTx, it, s.curFolders.Peek(), trTags, probeResult, probeFresh, probeOK)
+}
+
+// writeTrackTags upserts a track (and its artist/genre) from already
+// decoded tags, and fills in the owning folder's own tag fields if this
+// is the first track the folder's seen. tx is whatever transaction the
+// caller is batching writes under: the per-folder trTx for a synchronous
+// "changed" scan, or a pipeline writer's per-batch transaction. probeOK
+// indicates probeResult holds a usable ffprobe-derived duration/bitrate/
+// sample rate/channels/codec; probeFresh additionally means it still
+// needs writing to the probe cache.
+func (s *Scanner) writeTrackTags(
+	tx *gorm.DB, it *item, folder *db.Album, trTags tags.Tags,
+	probeResult probe.Result, probeFresh, probeOK bool,
+) error {
 	track := &db.Track{}
 	defer func() {
 		// folder's id will come from early return
 		// or save at the end
-		s.seenTracks[track.ID] = struct{}{}
+		s.markTrackSeen(track.ID)
 	}()
-	err := s.trTx.
+	albumID := folderID(folder)
+	err := tx.
 		Select("id, updated_at").
 		Where(db.Track{
-			AlbumID:  s.curFolders.PeekID(),
+			AlbumID:  albumID,
 			Filename: it.filename,
 		}).
 		First(track).
@@ -392,42 +599,45 @@ func (s *Scanner) handleTrack(it *item) error {
 	track.Filename = it.filename
 	track.FilenameUDec = decoded(it.filename)
 	track.Size = int(it.stat.Size())
-	track.AlbumID = s.curFolders.PeekID()
-	trTags, err := tags.New(it.fullPath)
-	if err != nil {
-		return ErrReadingTags
-	}
+	track.AlbumID = albumID
 	track.TagTitle = trTags.Title()
 	track.TagTitleUDec = decoded(trTags.Title())
 	track.TagTrackArtist = trTags.Artist()
 	track.TagTrackNumber = trTags.TrackNumber()
 	track.TagDiscNumber = trTags.DiscNumber()
 	track.TagBrainzID = trTags.BrainzID()
-	track.Length = trTags.Length()   // these two should be calculated
-	track.Bitrate = trTags.Bitrate() // ...from the file instead of tags
-	// ** begin set album artist basics
-	artistName := func() string {
-		if r := trTags.AlbumArtist(); r != "" {
-			return r
+	track.Length = trTags.Length()   // overridden below, field by field, when ffprobe has it
+	track.Bitrate = trTags.Bitrate() // ...since tags are frequently wrong or absent
+	if probeOK {
+		// ffprobe's own JSON can omit or garble an individual field (eg. a
+		// stream with no bit_rate in format), so only override a field the
+		// probe actually populated rather than trusting probeOK for all of
+		// them - otherwise a missing probed value clobbers a good tag one
+		// with a zero.
+		if probeResult.Length > 0 {
+			track.Length = probeResult.Length
 		}
-		if r := trTags.Artist(); r != "" {
-			return r
+		if probeResult.Bitrate > 0 {
+			track.Bitrate = probeResult.Bitrate
 		}
-		return "Unknown Artist"
-	}()
-	artist := &db.Artist{}
-	err = s.trTx.
-		Select("id").
-		Where("name=?", artistName).
-		First(artist).
-		Error
-	if gorm.IsRecordNotFoundError(err) {
-		artist.Name = artistName
-		artist.NameUDec = decoded(artistName)
-		if err := s.trTx.Save(artist).Error; err != nil {
-			return fmt.Errorf("writing artists table: %w", err)
+		if probeResult.SampleRate > 0 {
+			track.SampleRate = probeResult.SampleRate
+		}
+		if probeResult.Channels > 0 {
+			track.Channels = probeResult.Channels
+		}
+		if probeResult.Codec != "" {
+			track.Codec = probeResult.Codec
+		}
+		if probeFresh {
+			s.writeProbeCache(tx, it, probeResult)
 		}
 	}
+	// ** begin set album artist basics
+	artist, err := s.resolveMainArtist(tx, trTags)
+	if err != nil {
+		return fmt.Errorf("resolving artist: %w", err)
+	}
 	track.ArtistID = artist.ID
 	// ** begin set genre
 	genreName := func() string {
@@ -437,26 +647,28 @@ func (s *Scanner) handleTrack(it *item) error {
 		return "Unknown Genre"
 	}()
 	genre := &db.Genre{}
-	err = s.trTx.
+	err = tx.
 		Select("id").
 		Where("name=?", genreName).
 		First(genre).
 		Error
 	if gorm.IsRecordNotFoundError(err) {
 		genre.Name = genreName
-		if err := s.trTx.Save(genre).Error; err != nil {
+		if err := tx.Save(genre).Error; err != nil {
 			return fmt.Errorf("writing genres table: %w", err)
 		}
 	}
 	track.TagGenreID = genre.ID
 	// ** begin save the track
-	if err := s.trTx.Save(track).Error; err != nil {
+	if err := tx.Save(track).Error; err != nil {
 		return fmt.Errorf("writing track table: %w", err)
 	}
-	s.seenTracksNew++
+	if err := s.writeTrackArtists(tx, track, trTags, artist); err != nil {
+		return fmt.Errorf("writing track artists: %w", err)
+	}
+	s.incTracksNew()
 	// ** begin set album if this is the first track in the folder
-	folder := s.curFolders.Peek()
-	if !folder.ReceivedPaths || folder.ReceivedTags {
+	if folder == nil || !folder.ReceivedPaths || folder.ReceivedTags {
 		// the folder hasn't been modified or already has it's tags
 		return nil
 	}
@@ -465,7 +677,20 @@ func (s *Scanner) handleTrack(it *item) error {
 	folder.TagBrainzID = trTags.AlbumBrainzID()
 	folder.TagYear = trTags.Year()
 	folder.TagArtistID = artist.ID
+	if sibling := s.findAlbumByBrainzID(tx, folder.TagBrainzID, folder.ID); sibling != nil {
+		// same release split across folders (eg. a multi-disc set, or two
+		// rips of the same album by the same artist) - keep them crediting
+		// the same artist rather than re-resolving independently
+		folder.TagArtistID = sibling.TagArtistID
+	}
 	folder.TagGenreID = genre.ID
 	folder.ReceivedTags = true
 	return nil
 }
+
+func folderID(folder *db.Album) int {
+	if folder == nil {
+		return 0
+	}
+	return folder.ID
+}
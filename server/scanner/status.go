@@ -0,0 +1,140 @@
+package scanner
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/server/db"
+)
+
+// ScanPhase is where in its lifecycle a scan currently is.
+type ScanPhase string
+
+const (
+	PhaseIdle     ScanPhase = "idle"
+	PhaseWalking  ScanPhase = "walking"
+	PhaseCleaning ScanPhase = "cleaning"
+)
+
+// ScanStatus is a point-in-time snapshot of a Scanner's current (or most
+// recently finished) scan, returned by Scanner.Status(). it's the
+// scanner-side contract an admin /admin/scan/status handler renders as
+// JSON - MarshalJSON below is what makes that rendering useful.
+type ScanStatus struct {
+	Scanning    bool          `json:"scanning"`
+	StartedAt   time.Time     `json:"startedAt"`
+	Phase       ScanPhase     `json:"phase"`
+	CurrentPath string        `json:"currentPath"`
+	FilesSeen   int           `json:"filesSeen"`
+	FilesNew    int           `json:"filesNew"`
+	Errors      int           `json:"errors"`
+	ETA         time.Duration `json:"-"` // estimated time remaining, 0 if unknown; see MarshalJSON
+}
+
+// MarshalJSON renders ETA as whole seconds rather than the nanosecond
+// count time.Duration would otherwise marshal to, since seconds is what
+// an admin endpoint's JSON client actually wants.
+func (st ScanStatus) MarshalJSON() ([]byte, error) {
+	type alias ScanStatus
+	return json.Marshal(struct {
+		alias
+		ETASeconds float64 `json:"etaSeconds"`
+	}{alias(st), st.ETA.Seconds()})
+}
+
+// progress tracks a running scan's state behind a mutex, since it's
+// updated from the walk goroutine while being read from whatever
+// goroutine calls Scanner.Status().
+type progress struct {
+	mu           sync.Mutex
+	status       ScanStatus
+	total        int // best-effort estimate of total tracks, for the ETA
+	cancel       func()
+	progressLogN int
+}
+
+// Status returns a snapshot of the current scan, or the last one if none
+// is running.
+func (s *Scanner) Status() ScanStatus {
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	return s.progress.status
+}
+
+// Cancel stops a running scan as soon as the walk or pipeline notices,
+// rolling back whatever transaction is in flight. if no scan is running
+// it does nothing and returns ErrNotScanning.
+func (s *Scanner) Cancel() error {
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	if !s.progress.status.Scanning {
+		return ErrNotScanning
+	}
+	s.progress.cancel()
+	return nil
+}
+
+func (s *Scanner) startProgress(cancel func()) {
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	var total int
+	s.db.Model(&db.Track{}).Count(&total)
+	s.progress.total = total
+	s.progress.cancel = cancel
+	s.progress.status = ScanStatus{
+		Scanning:  true,
+		StartedAt: time.Now(),
+		Phase:     PhaseWalking,
+	}
+}
+
+func (s *Scanner) finishProgress() {
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	s.progress.status.Scanning = false
+	s.progress.status.Phase = PhaseIdle
+	s.progress.cancel = nil
+}
+
+func (s *Scanner) setPhase(phase ScanPhase) {
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	s.progress.status.Phase = phase
+}
+
+// reportProgress updates the running counters and ETA, and every 500th
+// call (one per walked file or directory, or per folder in a "changed"
+// scan) logs a progress line so ops can see a long scan is still moving.
+// filesSeen/filesNew come from Scanner.seenProgress() rather than reading
+// s.seenTracks/s.seenTracksNew directly, since during a pipelined
+// full/quick scan those are mutated by the writer goroutine while this
+// runs on the walk goroutine.
+func (s *Scanner) reportProgress(currentPath string) {
+	filesSeen, filesNew := s.seenProgress()
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	st := &s.progress.status
+	st.CurrentPath = currentPath
+	st.FilesSeen = filesSeen
+	st.FilesNew = filesNew
+	if elapsed := time.Since(st.StartedAt); elapsed > 0 && st.FilesSeen > 0 {
+		rate := float64(st.FilesSeen) / elapsed.Seconds()
+		if remaining := s.progress.total - st.FilesSeen; remaining > 0 && rate > 0 {
+			st.ETA = time.Duration(float64(remaining)/rate) * time.Second
+		} else {
+			st.ETA = 0
+		}
+	}
+	s.progress.progressLogN++
+	if s.progress.progressLogN%500 == 0 {
+		log.Printf("scan progress: %d files seen, %d new, eta %s\n", st.FilesSeen, st.FilesNew, st.ETA)
+	}
+}
+
+func (s *Scanner) recordError() {
+	s.progress.mu.Lock()
+	defer s.progress.mu.Unlock()
+	s.progress.status.Errors++
+}